@@ -0,0 +1,397 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nestCollector implements prometheus.Collector. Rather than hitting the
+// Nest API on every scrape, it keeps a mutex-protected cache of the last
+// successful NestData response, which a background goroutine refreshes:
+// every refreshInterval in "poll" mode, or on every stream "put" event in
+// "stream" mode. Collect always reads from that cache, so
+// scrapes are fast and cheap even if the Nest API is slow or unreachable.
+type nestCollector struct {
+	tm              *tokenManager
+	refreshInterval time.Duration
+	mode            string // "poll" or "stream"
+
+	mu               sync.Mutex
+	data             *NestData
+	up               bool
+	lastRefreshTime  time.Time
+	lastRefreshDur   time.Duration
+	cacheUpdatedTime time.Time
+	streamConnected  bool
+
+	// Housekeeping metric descriptors
+	upDesc              *prometheus.Desc
+	lastRefreshTimeDesc *prometheus.Desc
+	lastRefreshDurDesc  *prometheus.Desc
+	cacheUpdatedDesc    *prometheus.Desc
+	refreshIntervalDesc *prometheus.Desc
+	streamConnectedDesc *prometheus.Desc
+	tokenExpiresDesc    *prometheus.Desc
+
+	// Thermostat metric descriptors
+	stateDesc      *prometheus.Desc
+	tempDesc       *prometheus.Desc
+	targetTempDesc *prometheus.Desc
+	humidityDesc   *prometheus.Desc
+	hvacModeDesc   *prometheus.Desc
+	hvacStateDesc  *prometheus.Desc
+
+	// Camera metric descriptors
+	cameraOnlineDesc    *prometheus.Desc
+	cameraStreamingDesc *prometheus.Desc
+
+	// Protect (smoke/CO alarm) metric descriptors
+	protectBatteryDesc    *prometheus.Desc
+	protectCoAlarmDesc    *prometheus.Desc
+	protectSmokeAlarmDesc *prometheus.Desc
+
+	// Structure metric descriptors
+	structureAwayDesc *prometheus.Desc
+}
+
+func newNestCollector(tm *tokenManager, refreshInterval time.Duration, mode string) *nestCollector {
+	return &nestCollector{
+		tm:              tm,
+		refreshInterval: refreshInterval,
+		mode:            mode,
+
+		upDesc: prometheus.NewDesc(
+			"nest_up", "Whether the last refresh of the Nest API succeeded (1) or not (0)",
+			nil, nil,
+		),
+		lastRefreshTimeDesc: prometheus.NewDesc(
+			"nest_last_refresh_time",
+			"Unix timestamp of the last refresh attempt, successful or not",
+			nil, nil,
+		),
+		lastRefreshDurDesc: prometheus.NewDesc(
+			"nest_last_refresh_duration_seconds",
+			"How long the last refresh attempt took in seconds",
+			nil, nil,
+		),
+		cacheUpdatedDesc: prometheus.NewDesc(
+			"nest_cache_updated_time",
+			"Unix timestamp of the last successful refresh, i.e. the age of the cached data",
+			nil, nil,
+		),
+		refreshIntervalDesc: prometheus.NewDesc(
+			"nest_refresh_interval_seconds",
+			"The configured refresh interval in seconds",
+			nil, nil,
+		),
+		streamConnectedDesc: prometheus.NewDesc(
+			"nest_stream_connected",
+			"Whether the Nest REST Streaming connection is currently established (1) or not (0); always 0 in poll mode",
+			nil, nil,
+		),
+		tokenExpiresDesc: prometheus.NewDesc(
+			"nest_token_expires_timestamp_seconds",
+			"Unix timestamp when the current OAuth2 token expires; not exported while the expiry is unknown",
+			nil, nil,
+		),
+		stateDesc: prometheus.NewDesc(
+			"nest_state",
+			"Various true/false (1/0) metrics decribing nest state",
+			[]string{"thermostat", "property", "structure_id", "structure_name"}, nil,
+		),
+		tempDesc: prometheus.NewDesc(
+			"nest_temperature",
+			"The ambient temperature in F",
+			[]string{"thermostat", "structure_id", "structure_name"}, nil,
+		),
+		targetTempDesc: prometheus.NewDesc(
+			"nest_target_temperature",
+			"The target temperatures in F",
+			[]string{"thermostat", "type", "structure_id", "structure_name"}, nil,
+		),
+		humidityDesc: prometheus.NewDesc(
+			"nest_humidity",
+			"Current humidity in %",
+			[]string{"thermostat", "structure_id", "structure_name"}, nil,
+		),
+		hvacModeDesc: prometheus.NewDesc(
+			// heat, cool, heat-cool, eco, off
+			"nest_hvac_mode", "HVAC mode",
+			[]string{"thermostat", "mode", "structure_id", "structure_name"}, nil,
+		),
+		hvacStateDesc: prometheus.NewDesc(
+			"nest_hvac_state", "HVAC state",
+			[]string{"thermostat", "state", "structure_id", "structure_name"}, nil,
+		),
+		cameraOnlineDesc: prometheus.NewDesc(
+			"nest_camera_is_online",
+			"Whether a Nest camera is online (1) or not (0)",
+			[]string{"camera", "structure_id", "structure_name"}, nil,
+		),
+		cameraStreamingDesc: prometheus.NewDesc(
+			"nest_camera_is_streaming",
+			"Whether a Nest camera is currently streaming (1) or not (0)",
+			[]string{"camera", "structure_id", "structure_name"}, nil,
+		),
+		protectBatteryDesc: prometheus.NewDesc(
+			"nest_protect_battery_health",
+			"Battery health of a Nest Protect, as a label ('ok' or 'replace')",
+			[]string{"protect", "health", "structure_id", "structure_name"}, nil,
+		),
+		protectCoAlarmDesc: prometheus.NewDesc(
+			"nest_protect_co_alarm_state",
+			"CO alarm state of a Nest Protect, as a label ('ok', 'warning', or 'emergency')",
+			[]string{"protect", "state", "structure_id", "structure_name"}, nil,
+		),
+		protectSmokeAlarmDesc: prometheus.NewDesc(
+			"nest_protect_smoke_alarm_state",
+			"Smoke alarm state of a Nest Protect, as a label ('ok', 'warning', or 'emergency')",
+			[]string{"protect", "state", "structure_id", "structure_name"}, nil,
+		),
+		structureAwayDesc: prometheus.NewDesc(
+			"nest_structure_away",
+			"Away state of a structure, as a label ('home', 'away', or 'auto-away')",
+			[]string{"structure", "state"}, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *nestCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.lastRefreshTimeDesc
+	ch <- c.lastRefreshDurDesc
+	ch <- c.cacheUpdatedDesc
+	ch <- c.refreshIntervalDesc
+	ch <- c.streamConnectedDesc
+	ch <- c.tokenExpiresDesc
+	ch <- c.stateDesc
+	ch <- c.tempDesc
+	ch <- c.targetTempDesc
+	ch <- c.humidityDesc
+	ch <- c.hvacModeDesc
+	ch <- c.hvacStateDesc
+	ch <- c.cameraOnlineDesc
+	ch <- c.cameraStreamingDesc
+	ch <- c.protectBatteryDesc
+	ch <- c.protectCoAlarmDesc
+	ch <- c.protectSmokeAlarmDesc
+	ch <- c.structureAwayDesc
+}
+
+// Collect implements prometheus.Collector. It never talks to the Nest API
+// itself; it just re-emits whatever the background refresh loop last
+// cached, so scrapes stay fast regardless of Nest API latency.
+func (c *nestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	data := c.data
+	up := c.up
+	lastRefreshTime := c.lastRefreshTime
+	lastRefreshDur := c.lastRefreshDur
+	cacheUpdatedTime := c.cacheUpdatedTime
+	streamConnected := c.streamConnected
+	c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, boolToFloat(up))
+	ch <- prometheus.MustNewConstMetric(c.refreshIntervalDesc, prometheus.GaugeValue,
+		c.refreshInterval.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.streamConnectedDesc, prometheus.GaugeValue,
+		boolToFloat(streamConnected))
+	if expiry := c.tm.Expiry(); !expiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.tokenExpiresDesc, prometheus.GaugeValue,
+			float64(expiry.Unix()))
+	}
+	if !lastRefreshTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.lastRefreshTimeDesc, prometheus.GaugeValue,
+			float64(lastRefreshTime.Unix()))
+		ch <- prometheus.MustNewConstMetric(c.lastRefreshDurDesc, prometheus.GaugeValue,
+			lastRefreshDur.Seconds())
+	}
+	if data == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.cacheUpdatedDesc, prometheus.GaugeValue,
+		float64(cacheUpdatedTime.Unix()))
+
+	for _, t := range data.Devices.Thermostats {
+		c.collectThermostat(ch, t, data.Structures)
+	}
+	for _, cam := range data.Devices.Cameras {
+		c.collectCamera(ch, cam, data.Structures)
+	}
+	for _, p := range data.Devices.SmokeCoAlarms {
+		c.collectProtect(ch, p, data.Structures)
+	}
+	for _, s := range data.Structures {
+		c.collectStructure(ch, s)
+	}
+}
+
+// structureName returns the name of structureID in structures, or "" if
+// it's not known. Devices label their metrics with both, so a home with
+// no name set still groups correctly on structure_id.
+func structureName(structures map[string]Structure, structureID string) string {
+	return structures[structureID].Name
+}
+
+func (c *nestCollector) collectThermostat(ch chan<- prometheus.Metric, t Device, structures map[string]Structure) {
+	sid, sname := t.StructureId, structureName(structures, t.StructureId)
+
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.IsOnline), t.Name, "is_online", sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.CanCool), t.Name, "can_cool", sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.CanHeat), t.Name, "can_heat", sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.IsUsingEmergencyHeat), t.Name, "is_using_emergency_heat", sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.HasFan), t.Name, "has_fan", sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.FanTimerActive), t.Name, "fan_timer_active", sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue,
+		boolToFloat(t.HasLeaf), t.Name, "has_leaf", sid, sname)
+
+	ch <- prometheus.MustNewConstMetric(c.tempDesc, prometheus.GaugeValue,
+		t.AmbientTemperatureF, t.Name, sid, sname)
+
+	// The hvac state and mode stats are implemented by having a metric
+	// with the label of the current hvac state. Other states/modes
+	// aren't present.
+	if t.HvacMode == "heat" || t.HvacMode == "cool" {
+		ch <- prometheus.MustNewConstMetric(c.targetTempDesc, prometheus.GaugeValue,
+			t.TargetTemperatureF, t.Name, "target_temperature", sid, sname)
+	} else if t.HvacMode == "heat-cool" {
+		ch <- prometheus.MustNewConstMetric(c.targetTempDesc, prometheus.GaugeValue,
+			t.TargetTemperatureHighF, t.Name, "target_temperature_high", sid, sname)
+		ch <- prometheus.MustNewConstMetric(c.targetTempDesc, prometheus.GaugeValue,
+			t.TargetTemperatureLowF, t.Name, "target_temperature_low", sid, sname)
+	} else if t.HvacMode == "eco" {
+		ch <- prometheus.MustNewConstMetric(c.targetTempDesc, prometheus.GaugeValue,
+			t.AwayTemperatureHighF, t.Name, "away_temperature_high", sid, sname)
+		ch <- prometheus.MustNewConstMetric(c.targetTempDesc, prometheus.GaugeValue,
+			t.AwayTemperatureLowF, t.Name, "away_temperature_low", sid, sname)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.hvacStateDesc, prometheus.GaugeValue,
+		1.0, t.Name, t.HvacState, sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.hvacModeDesc, prometheus.GaugeValue,
+		1.0, t.Name, t.HvacMode, sid, sname)
+
+	ch <- prometheus.MustNewConstMetric(c.humidityDesc, prometheus.GaugeValue,
+		t.Humidity, t.Name, sid, sname)
+}
+
+func (c *nestCollector) collectCamera(ch chan<- prometheus.Metric, cam Camera, structures map[string]Structure) {
+	sid, sname := cam.StructureId, structureName(structures, cam.StructureId)
+
+	ch <- prometheus.MustNewConstMetric(c.cameraOnlineDesc, prometheus.GaugeValue,
+		boolToFloat(cam.IsOnline), cam.Name, sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.cameraStreamingDesc, prometheus.GaugeValue,
+		boolToFloat(cam.IsStreaming), cam.Name, sid, sname)
+}
+
+func (c *nestCollector) collectProtect(ch chan<- prometheus.Metric, p Protect, structures map[string]Structure) {
+	sid, sname := p.StructureId, structureName(structures, p.StructureId)
+
+	ch <- prometheus.MustNewConstMetric(c.protectBatteryDesc, prometheus.GaugeValue,
+		1.0, p.Name, p.BatteryHealth, sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.protectCoAlarmDesc, prometheus.GaugeValue,
+		1.0, p.Name, p.CoAlarmState, sid, sname)
+	ch <- prometheus.MustNewConstMetric(c.protectSmokeAlarmDesc, prometheus.GaugeValue,
+		1.0, p.Name, p.SmokeAlarmState, sid, sname)
+}
+
+func (c *nestCollector) collectStructure(ch chan<- prometheus.Metric, s Structure) {
+	name := s.Name
+	if name == "" {
+		name = s.StructureId
+	}
+	ch <- prometheus.MustNewConstMetric(c.structureAwayDesc, prometheus.GaugeValue,
+		1.0, name, s.Away)
+}
+
+// run keeps the device cache up to date until stopped. It is meant to be
+// run in its own goroutine for the lifetime of the process. In "stream"
+// mode it maintains a persistent SSE connection (see stream.go); otherwise
+// it falls back to polling the Nest API every refreshInterval.
+func (c *nestCollector) run() {
+	if c.mode == "stream" {
+		c.runStream()
+		return
+	}
+	c.runPoll()
+}
+
+func (c *nestCollector) runPoll() {
+	for {
+		c.refresh()
+		time.Sleep(c.refreshInterval)
+	}
+}
+
+// refresh fetches the current devices and structures from the Nest API and
+// stores the result in the cache, recording whether it succeeded so nest_up
+// reflects API health even when stale data is still being served.
+func (c *nestCollector) refresh() {
+	start := time.Now()
+	data, err := getNestData(c.tm)
+	duration := time.Since(start)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastRefreshTime = start
+	c.lastRefreshDur = duration
+	if err != nil {
+		log.Println(err)
+		c.up = false
+		return
+	}
+	c.data = data
+	c.up = true
+	c.cacheUpdatedTime = start
+}
+
+// getDevice returns the cached state for a single thermostat, for use by
+// the control API when validating writes against the device's current
+// capabilities.
+func (c *nestCollector) getDevice(deviceID string) (Device, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		return Device{}, false
+	}
+	d, ok := c.data.Devices.Thermostats[deviceID]
+	return d, ok
+}
+
+// setStreamConnected records whether the SSE stream is currently
+// established, for the nest_stream_connected gauge.
+func (c *nestCollector) setStreamConnected(connected bool) {
+	c.mu.Lock()
+	c.streamConnected = connected
+	c.mu.Unlock()
+}
+
+// setFromStream installs a freshly received snapshot in the cache,
+// mirroring what refresh does for the poll path but without recording a
+// duration, since the update arrived asynchronously over the stream.
+func (c *nestCollector) setFromStream(data *NestData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.data = data
+	c.up = true
+	c.lastRefreshTime = now
+	c.cacheUpdatedTime = now
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HvacMode is one of the values the Nest API accepts for a thermostat's
+// hvac_mode field.
+type HvacMode string
+
+const (
+	HvacModeOff      HvacMode = "off"
+	HvacModeHeat     HvacMode = "heat"
+	HvacModeCool     HvacMode = "cool"
+	HvacModeHeatCool HvacMode = "heat-cool"
+	HvacModeEco      HvacMode = "eco"
+)
+
+// Valid reports whether m is one of the modes the Nest API accepts.
+func (m HvacMode) Valid() bool {
+	switch m {
+	case HvacModeOff, HvacModeHeat, HvacModeCool, HvacModeHeatCool, HvacModeEco:
+		return true
+	}
+	return false
+}
+
+func (m HvacMode) MarshalJSON() ([]byte, error) {
+	if !m.Valid() {
+		return nil, fmt.Errorf("invalid hvac mode %q", string(m))
+	}
+	return json.Marshal(string(m))
+}
+
+func (m *HvacMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	mode := HvacMode(s)
+	if !mode.Valid() {
+		return fmt.Errorf("invalid hvac mode %q", s)
+	}
+	*m = mode
+	return nil
+}
+
+// Write-attempt counters. Unlike the scrape-time gauges in collector.go,
+// these are incremented directly from the control HTTP handlers as writes
+// happen, so they're registered as ordinary counters rather than collected
+// from a cache.
+var writeAttemptsStat = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "nest_write_attempts_total",
+		Help: "Count of control API write attempts against the Nest API, by endpoint and result",
+	},
+	[]string{"endpoint", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(writeAttemptsStat)
+}
+
+// controlServer exposes a small authenticated HTTP API for writing
+// thermostat settings back to the Nest API. It validates requests against
+// the collector's cached device state before issuing the PUT, so obviously
+// invalid writes (e.g. setting a cooling-only thermostat to heat) are
+// rejected without spending an API call.
+type controlServer struct {
+	token     string // shared secret required of callers
+	tm        *tokenManager
+	collector *nestCollector
+
+	// redirectMu guards redirectHost, which is read and written from every
+	// inbound request's goroutine, unlike nestCollector's cache which only
+	// ever has one writer.
+	redirectMu   sync.Mutex
+	redirectHost string // cached "scheme://host" PUTs get redirected to; see getRedirectHost
+}
+
+func newControlServer(token string, tm *tokenManager, collector *nestCollector) *controlServer {
+	return &controlServer{token: token, tm: tm, collector: collector}
+}
+
+func (s *controlServer) registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/thermostats/", s.handleThermostat)
+}
+
+func (s *controlServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	want := []byte("Bearer " + s.token)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// getRedirectHost returns the cached "scheme://host" the Nest API
+// permanently redirects writes to, the same way CachedRedirectURL does for
+// reads. Unlike the read path, only the host is cached here: reads always
+// hit the same root resource, but writes are per-device, so the path is
+// rebuilt from the caller's deviceID on every call (see putURL).
+func (s *controlServer) getRedirectHost() string {
+	s.redirectMu.Lock()
+	defer s.redirectMu.Unlock()
+	return s.redirectHost
+}
+
+func (s *controlServer) setRedirectHost(host string) {
+	s.redirectMu.Lock()
+	s.redirectHost = host
+	s.redirectMu.Unlock()
+}
+
+func (s *controlServer) handleThermostat(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/thermostats/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	deviceID, field := parts[0], parts[1]
+
+	device, ok := s.collector.getDevice(deviceID)
+	if !ok {
+		http.Error(w, "unknown thermostat", http.StatusNotFound)
+		return
+	}
+
+	switch field {
+	case "target_temperature":
+		s.setTargetTemperature(w, r, device)
+	case "hvac_mode":
+		s.setHvacMode(w, r, device)
+	case "fan_timer":
+		s.setFanTimer(w, r, device)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type targetTemperatureRequest struct {
+	Temperature float64 `json:"temperature"`
+}
+
+func (s *controlServer) setTargetTemperature(w http.ResponseWriter, r *http.Request, d Device) {
+	var req targetTemperatureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if d.IsLocked {
+		min, max := d.lockedTempRange()
+		if req.Temperature < min || req.Temperature > max {
+			http.Error(w, fmt.Sprintf(
+				"target temperature %.1f outside locked range %.1f-%.1f",
+				req.Temperature, min, max), http.StatusBadRequest)
+			return
+		}
+	}
+	field := "target_temperature_f"
+	if d.TemperatureScale == "C" {
+		field = "target_temperature_c"
+	}
+	s.put(w, d.DeviceId, "target_temperature", map[string]interface{}{
+		field: req.Temperature,
+	})
+}
+
+type hvacModeRequest struct {
+	Mode HvacMode `json:"mode"`
+}
+
+func (s *controlServer) setHvacMode(w http.ResponseWriter, r *http.Request, d Device) {
+	var req hvacModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Mode {
+	case HvacModeHeat:
+		if !d.CanHeat {
+			http.Error(w, "thermostat cannot heat", http.StatusBadRequest)
+			return
+		}
+	case HvacModeCool:
+		if !d.CanCool {
+			http.Error(w, "thermostat cannot cool", http.StatusBadRequest)
+			return
+		}
+	case HvacModeHeatCool:
+		if !d.CanHeat || !d.CanCool {
+			http.Error(w, "thermostat cannot heat-cool", http.StatusBadRequest)
+			return
+		}
+	}
+	s.put(w, d.DeviceId, "hvac_mode", map[string]interface{}{
+		"hvac_mode": req.Mode,
+	})
+}
+
+type fanTimerRequest struct {
+	Active          bool `json:"active"`
+	DurationMinutes int  `json:"duration_minutes,omitempty"`
+}
+
+func (s *controlServer) setFanTimer(w http.ResponseWriter, r *http.Request, d Device) {
+	var req fanTimerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !d.HasFan {
+		http.Error(w, "thermostat has no fan", http.StatusBadRequest)
+		return
+	}
+	body := map[string]interface{}{"fan_timer_active": req.Active}
+	if req.DurationMinutes > 0 {
+		body["fan_timer_duration"] = req.DurationMinutes
+	}
+	s.put(w, d.DeviceId, "fan_timer", body)
+}
+
+// put issues a PUT against the Nest API for a single thermostat and
+// forwards the result back to the caller, tracking the outcome in
+// writeAttemptsStat.
+func (s *controlServer) put(w http.ResponseWriter, deviceID, endpoint string, body map[string]interface{}) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		writeAttemptsStat.WithLabelValues(endpoint, "error").Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, respBody, err := s.doPut(deviceID, payload)
+	if err != nil {
+		writeAttemptsStat.WithLabelValues(endpoint, "error").Inc()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		if err := s.tm.Refresh(); err != nil {
+			writeAttemptsStat.WithLabelValues(endpoint, "error").Inc()
+			http.Error(w, fmt.Sprintf("token expired and refresh failed: %s", err),
+				http.StatusBadGateway)
+			return
+		}
+		resp, respBody, err = s.doPut(deviceID, payload)
+		if err != nil {
+			writeAttemptsStat.WithLabelValues(endpoint, "error").Inc()
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		writeAttemptsStat.WithLabelValues(endpoint, "success").Inc()
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBody)
+	case http.StatusTooManyRequests:
+		writeAttemptsStat.WithLabelValues(endpoint, "rate_limited").Inc()
+		http.Error(w, "rate limited by Nest API, see Retry-After", http.StatusTooManyRequests)
+	default:
+		writeAttemptsStat.WithLabelValues(endpoint, "error").Inc()
+		http.Error(w, fmt.Sprintf("HTTP code %d: %s", resp.StatusCode, respBody),
+			http.StatusBadGateway)
+	}
+}
+
+// putURL builds the PUT URL for a single thermostat. host is the cached
+// "scheme://host" from a prior redirect, or "" to hit the default API host;
+// the path is always rebuilt from deviceID, since a cached host must not be
+// allowed to paper over which device a write actually targets.
+func putURL(host, deviceID, token string) string {
+	if host == "" {
+		host = "https://developer-api.nest.com"
+	}
+	return host + "/devices/thermostats/" + deviceID + "?auth=" + token
+}
+
+// doPut issues a single PUT against the Nest API for deviceID and returns
+// the raw response, without interpreting the status code. Callers retry
+// once after a token refresh if this reports 401 Unauthorized.
+func (s *controlServer) doPut(deviceID string, payload []byte) (*http.Response, []byte, error) {
+	// See https://developers.nest.com/documentation/cloud/how-to-handle-redirects#store_the_redirected_location
+	// for why there is a cached redirect host; writes get redirected the
+	// same way reads do.
+	host := s.getRedirectHost()
+	url := putURL(host, deviceID, s.tm.Token())
+
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if respHost := resp.Request.URL.Scheme + "://" + resp.Request.URL.Host; respHost != host {
+		// We were redirected, or no host was cached yet, so cache the host
+		// the request ended up at. The path isn't part
+		// of what's cached: it's specific to this deviceID.
+		s.setRedirectHost(respHost)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// lockedTempRange returns the min/max temperature a locked thermostat can
+// be set to, in whichever scale the thermostat is currently using.
+func (d Device) lockedTempRange() (float64, float64) {
+	if d.TemperatureScale == "C" {
+		return d.LockedTempMinC, d.LockedTempMaxC
+	}
+	return d.LockedTempMinF, d.LockedTempMaxF
+}
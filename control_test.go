@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+// TestPutURLRebuildsPathPerDevice guards against a past bug where caching
+// the full redirect URL (path included) made every write after the first
+// one land on whichever device happened to be redirected first.
+func TestPutURLRebuildsPathPerDevice(t *testing.T) {
+	cachedHost := "https://region-1.developer-api.nest.com"
+
+	urlA := putURL(cachedHost, "device-a", "tok")
+	urlB := putURL(cachedHost, "device-b", "tok")
+
+	wantA := "https://region-1.developer-api.nest.com/devices/thermostats/device-a?auth=tok"
+	wantB := "https://region-1.developer-api.nest.com/devices/thermostats/device-b?auth=tok"
+
+	if urlA != wantA {
+		t.Errorf("putURL(cachedHost, %q, ...) = %q, want %q", "device-a", urlA, wantA)
+	}
+	if urlB != wantB {
+		t.Errorf("putURL(cachedHost, %q, ...) = %q, want %q", "device-b", urlB, wantB)
+	}
+}
+
+func TestPutURLDefaultsToAPIRootWithoutCachedHost(t *testing.T) {
+	got := putURL("", "device-a", "tok")
+	want := "https://developer-api.nest.com/devices/thermostats/device-a?auth=tok"
+	if got != want {
+		t.Errorf("putURL(\"\", ...) = %q, want %q", got, want)
+	}
+}
@@ -16,11 +16,65 @@ import (
 
 type Config struct {
 	Token           string
-	RefreshInterval int `toml:"refresh_interval"`
+	RefreshToken    string `toml:"refresh_token"`
+	ClientID        string `toml:"client_id"`
+	ClientSecret    string `toml:"client_secret"`
+	TokenExpiry     int64  `toml:"token_expiry"` // unix timestamp, 0 if unknown
+	RefreshInterval int    `toml:"refresh_interval"`
+	ControlToken    string `toml:"control_token"`
+	Mode            string `toml:"mode"` // "poll" or "stream", defaults to "poll"
+}
+
+// NestData is the shape of the Nest API's root resource: every device,
+// grouped by type, plus the structures (homes) they belong to.
+type NestData struct {
+	Devices    Devices
+	Structures map[string]Structure
 }
 
 type Devices struct {
-	Thermostats map[string]Device
+	Thermostats   map[string]Device
+	Cameras       map[string]Camera
+	SmokeCoAlarms map[string]Protect `json:"smoke_co_alarms"`
+}
+
+// Structure is a Nest "home": a named collection of devices with a shared
+// away/home state.
+type Structure struct {
+	StructureId   string `json:"structure_id"`
+	Name          string
+	CountryCode   string   `json:"country_code"`
+	Away          string   // "home", "away", or "auto-away"
+	Thermostats   []string `json:"thermostats"`
+	SmokeCoAlarms []string `json:"smoke_co_alarms"`
+	Cameras       []string `json:"cameras"`
+}
+
+type Camera struct {
+	DeviceId        string `json:"device_id"`
+	SoftwareVersion string `json:"software_version"`
+	StructureId     string `json:"structure_id"`
+	WhereId         string `json:"where_id"`
+	WhereName       string `json:"where_name"`
+	Name            string
+	NameLong        string `json:"name_long"`
+	IsOnline        bool   `json:"is_online"`
+	IsStreaming     bool   `json:"is_streaming"`
+}
+
+// Protect is a Nest Protect smoke/CO alarm.
+type Protect struct {
+	DeviceId        string `json:"device_id"`
+	SoftwareVersion string `json:"software_version"`
+	StructureId     string `json:"structure_id"`
+	WhereId         string `json:"where_id"`
+	WhereName       string `json:"where_name"`
+	Name            string
+	NameLong        string `json:"name_long"`
+	IsOnline        bool   `json:"is_online"`
+	BatteryHealth   string `json:"battery_health"`    // "ok" or "replace"
+	CoAlarmState    string `json:"co_alarm_state"`    // "ok", "warning", or "emergency"
+	SmokeAlarmState string `json:"smoke_alarm_state"` // "ok", "warning", or "emergency"
 }
 
 type Device struct {
@@ -53,7 +107,7 @@ type Device struct {
 	EcoTemperatureLowC        float64 `json:"eco_temperature_low_c"`
 	EcoTemperatureLowF        float64 `json:"eco_temperature_low_f"`
 	IsLocked                  bool    `json:"is_locked"`
-	LockedTempMinC            float64 `json:_min_c"`
+	LockedTempMinC            float64 `json:"locked_temp_min_c"`
 	LockedTempMinF            float64 `json:"locked_temp_min_f"`
 	LockedTempMaxC            float64 `json:"locked_temp_max_c"`
 	LockedTempMaxF            float64 `json:"locked_temp_max_f"`
@@ -75,59 +129,17 @@ type Device struct {
 	HvacState                 string `json:"hvac_state"`
 }
 
-// Prometheus stats
-var (
-	stateStat = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "nest_state",
-			Help: "Various true/false (1/0) metrics decribing nest state",
-		},
-		[]string{"thermostat", "property"},
-	)
-	tempStat = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "nest_temperature",
-			Help: "The ambient temperature in F",
-		},
-		[]string{"thermostat"},
-	)
-	targetTempStat = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "nest_target_temperature",
-			Help: "The target temperatures in F",
-		},
-		[]string{"thermostat", "type"},
-	)
-	humidityStat = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "nest_humidity",
-			Help: "Current humidity in %",
-		},
-		[]string{"thermostat"},
-	)
-	hvacModeStat = prometheus.NewGaugeVec(
-		// heat, cool, heat-cool, eco, off
-		prometheus.GaugeOpts{
-			Name: "nest_hvac_mode",
-			Help: "HVAC mode",
-		},
-		[]string{"thermostat", "mode"},
-	)
-	hvacStateStat = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "nest_hvac_state",
-			Help: "HVAC state",
-		},
-		[]string{"thermostat", "state"},
-	)
-)
-
 // Flags
 var (
 	addr = flag.String("listen-address", ":9264",
 		"The address to listen on for HTTP requests.")
 	configFile = flag.String("config", "~/.nest_exporter.toml",
 		"Path to the configuration file.")
+	authMode = flag.Bool("auth", false,
+		"Run the OAuth2 authorization flow to obtain a token, write it "+
+			"to -config, then exit.")
+	authListenAddr = flag.String("auth-listen-address", "localhost:9265",
+		"Address to listen on for the OAuth2 callback during -auth.")
 )
 
 // Other
@@ -135,172 +147,108 @@ var (
 	CachedRedirectURL string // because nest wants you to reuse the redirect URL
 )
 
-func init() {
-	flag.Parse()
-	prometheus.MustRegister(stateStat)
-	prometheus.MustRegister(tempStat)
-	prometheus.MustRegister(targetTempStat)
-	prometheus.MustRegister(humidityStat)
-	prometheus.MustRegister(hvacModeStat)
-	prometheus.MustRegister(hvacStateStat)
+// getNestData fetches the current devices and structures from the Nest
+// API, transparently refreshing the token and retrying once if the API
+// reports it has expired.
+func getNestData(tm *tokenManager) (*NestData, error) {
+	data, status, err := fetchNestData(tm.Token())
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusUnauthorized {
+		if err := tm.Refresh(); err != nil {
+			return nil, fmt.Errorf("token expired and refresh failed: %w", err)
+		}
+		// The cached redirect URL carries the old token, so drop it.
+		CachedRedirectURL = ""
+		data, status, err = fetchNestData(tm.Token())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("HTTP code %d", status)
+	}
+	return data, nil
 }
 
-func getDevices(token string) (*Devices, error) {
+func fetchNestData(token string) (*NestData, int, error) {
 	// See https://developers.nest.com/documentation/cloud/how-to-handle-redirects#store_the_redirected_location
-	// for why there is a cached redirect URL
+	// for why there is a cached redirect URL. We hit the API root rather
+	// than devices.json so the response also carries the structures map.
 	url := CachedRedirectURL
 	if url == "" {
-		url = "https://developer-api.nest.com/devices.json/?auth=" + token
+		url = "https://developer-api.nest.com/?auth=" + token
 	}
 	resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
 	respURL := resp.Request.URL.String()
 	if respURL != url {
 		// We were redirected, so cache the new URL
 		CachedRedirectURL = respURL
 	}
-	if err != nil {
-		return nil, err
-	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP code %d: %s", resp.StatusCode, body)
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, resp.StatusCode, nil
+		}
+		return nil, 0, fmt.Errorf("HTTP code %d: %s", resp.StatusCode, body)
 	}
-	devices := &Devices{}
-	err = json.Unmarshal(body, devices)
-	if err != nil {
-		return nil, err
+	data := &NestData{}
+	if err := json.Unmarshal(body, data); err != nil {
+		return nil, 0, err
 	}
-	return devices, nil
+	return data, resp.StatusCode, nil
 }
 
 func main() {
+	flag.Parse()
+
 	var config Config
 	if _, err := toml.DecodeFile(*configFile, &config); err != nil {
 		log.Fatal(err)
 	}
+
+	if *authMode {
+		if err := runAuthFlow(*configFile, config, *authListenAddr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if config.RefreshInterval == 0 {
 		// Default to 2 minute refreshes
 		config.RefreshInterval = 120
 	}
-	ticker := time.NewTicker(time.Duration(config.RefreshInterval) *
-		time.Second)
-	go func() {
-		for {
-			devices, err := getDevices(config.Token)
-			if err != nil {
-				log.Println(err)
-			} else {
-				for _, t := range devices.Thermostats {
-					// States - 1 for on, 0 for off
-					var isOnline float64
-					var canCool float64
-					var canHeat float64
-					var isUsingEmergencyHeat float64
-					var hasFan float64
-					var fanTimerActive float64
-					var hasLeaf float64
-
-					if t.IsOnline {
-						isOnline = 1
-					}
-					if t.CanCool {
-						canCool = 1
-					}
-					if t.CanHeat {
-						canHeat = 1
-					}
-					if t.IsUsingEmergencyHeat {
-						isUsingEmergencyHeat = 1
-					}
-					if t.HasFan {
-						hasFan = 1
-					}
-					if t.FanTimerActive {
-						fanTimerActive = 1
-					}
-					if t.HasLeaf {
-						hasLeaf = 1
-					}
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "property": "is_online",
-					}).Set(isOnline)
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "property": "can_cool",
-					}).Set(canCool)
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "property": "can_heat",
-					}).Set(canHeat)
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name,
-						"property":   "is_using_emergency_heat",
-					}).Set(isUsingEmergencyHeat)
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "property": "has_fan",
-					}).Set(hasFan)
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "property": "fan_timer_active",
-					}).Set(fanTimerActive)
-					stateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "property": "has_leaf",
-					}).Set(hasLeaf)
-
-					// Ambient Temperature
-					tempStat.With(prometheus.Labels{
-						"thermostat": t.Name,
-					}).Set(float64(t.AmbientTemperatureF))
-
-					// Target Temperatures
-					targetTempStat.Reset()
-					tts := targetTempStat.MustCurryWith(prometheus.Labels{
-						"thermostat": t.Name,
-					})
-
-					if t.HvacMode == "heat" || t.HvacMode == "cool" {
-						tts.With(prometheus.Labels{
-							"type": "target_temperature",
-						}).Set(t.TargetTemperatureF)
-					} else if t.HvacMode == "heat-cool" {
-						tts.With(prometheus.Labels{
-							"type": "target_temperature_high",
-						}).Set(t.TargetTemperatureHighF)
-						tts.With(prometheus.Labels{
-							"type": "target_temperature_low",
-						}).Set(t.TargetTemperatureLowF)
-					} else if t.HvacMode == "eco" {
-						tts.With(prometheus.Labels{
-							"type": "away_temperature_high",
-						}).Set(t.AwayTemperatureHighF)
-						tts.With(prometheus.Labels{
-							"type": "away_temperature_low",
-						}).Set(t.AwayTemperatureLowF)
-					}
+	refreshInterval := time.Duration(config.RefreshInterval) * time.Second
+	switch config.Mode {
+	case "":
+		config.Mode = "poll"
+	case "poll", "stream":
+	default:
+		log.Fatalf("invalid mode %q, must be \"poll\" or \"stream\"", config.Mode)
+	}
 
-					// The hvac state and mode stats are implemented by having
-					// a metric with the label of the current hvac state.
-					// Other states/modes aren't present.
-					hvacStateStat.Reset() // Remove the previous hvac state
-					hvacStateStat.With(prometheus.Labels{
-						"thermostat": t.Name, "state": t.HvacState,
-					}).Set(1.0)
+	tm, err := newTokenManager(*configFile, config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-					hvacModeStat.Reset() // Remove the previous hvac mode
-					hvacModeStat.With(prometheus.Labels{
-						"thermostat": t.Name, "mode": t.HvacMode,
-					}).Set(1.0)
+	collector := newNestCollector(tm, refreshInterval, config.Mode)
+	prometheus.MustRegister(collector)
+	go collector.run()
 
-					humidityStat.With(
-						prometheus.Labels{"thermostat": t.Name}).Set(
-						t.Humidity)
-				}
-			}
-			// Wait until the next tick
-			<-ticker.C
-		}
-	}()
+	if config.ControlToken == "" {
+		log.Println("control_token not set, the write API is disabled")
+	}
+	control := newControlServer(config.ControlToken, tm, collector)
+	control.registerRoutes(http.DefaultServeMux)
 
 	log.Println("Listening on", *addr)
 	http.Handle("/metrics", promhttp.Handler())
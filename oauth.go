@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	nestAuthURL  = "https://home.nest.com/login/oauth2"
+	nestTokenURL = "https://api.home.nest.com/oauth2/access_token"
+)
+
+// authRefreshesStat counts OAuth2 token refresh attempts, tagged by
+// outcome, the same pattern as writeAttemptsStat in control.go.
+var authRefreshesStat = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "nest_auth_refreshes_total",
+		Help: "Count of OAuth2 token refresh attempts, by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(authRefreshesStat)
+}
+
+// tokenManager owns the current Nest OAuth2 token. It refreshes the token
+// transparently via the refresh_token grant whenever the API reports it
+// has expired, and persists the new token back to the config file so it
+// survives restarts. Secrets are kept encrypted at rest: see encryptSecret.
+type tokenManager struct {
+	configPath   string
+	key          []byte
+	clientID     string
+	clientSecret string
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+}
+
+func newTokenManager(configPath string, config Config) (*tokenManager, error) {
+	key, err := loadOrCreateKey(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading token encryption key: %w", err)
+	}
+	clientSecret, err := decryptSecret(key, config.ClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting client_secret: %w", err)
+	}
+	accessToken, err := decryptSecret(key, config.Token)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting token: %w", err)
+	}
+	refreshToken, err := decryptSecret(key, config.RefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting refresh_token: %w", err)
+	}
+
+	var expiry time.Time
+	if config.TokenExpiry > 0 {
+		expiry = time.Unix(config.TokenExpiry, 0)
+	}
+	return &tokenManager{
+		configPath:   configPath,
+		key:          key,
+		clientID:     config.ClientID,
+		clientSecret: clientSecret,
+		accessToken:  accessToken,
+		refreshToken: refreshToken,
+		expiry:       expiry,
+	}, nil
+}
+
+// Token returns the current access token.
+func (m *tokenManager) Token() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accessToken
+}
+
+// Expiry returns when the current access token expires, or the zero
+// value if that isn't known.
+func (m *tokenManager) Expiry() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expiry
+}
+
+// Refresh exchanges the stored refresh token for a new access token and
+// persists it to disk. It's called whenever the Nest API responds with
+// 401 Unauthorized.
+func (m *tokenManager) Refresh() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.refreshToken == "" || m.clientID == "" || m.clientSecret == "" {
+		authRefreshesStat.WithLabelValues("error").Inc()
+		return fmt.Errorf("no refresh_token/client_id/client_secret configured, re-run with -auth")
+	}
+
+	tok, err := exchangeToken(url.Values{
+		"client_id":     {m.clientID},
+		"client_secret": {m.clientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {m.refreshToken},
+	})
+	if err != nil {
+		authRefreshesStat.WithLabelValues("error").Inc()
+		return err
+	}
+
+	m.accessToken = tok.AccessToken
+	if tok.RefreshToken != "" {
+		m.refreshToken = tok.RefreshToken
+	}
+	if tok.ExpiresIn > 0 {
+		m.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	if err := m.persist(); err != nil {
+		log.Println("failed to persist refreshed token:", err)
+	}
+	authRefreshesStat.WithLabelValues("success").Inc()
+	return nil
+}
+
+// persist writes the current token back into configPath, preserving
+// whatever else is already in the file. Token and refresh_token are
+// encrypted before they hit disk.
+func (m *tokenManager) persist() error {
+	var config Config
+	if _, err := toml.DecodeFile(m.configPath, &config); err != nil {
+		return err
+	}
+	config.Token = encryptSecret(m.key, m.accessToken)
+	config.RefreshToken = encryptSecret(m.key, m.refreshToken)
+	if !m.expiry.IsZero() {
+		config.TokenExpiry = m.expiry.Unix()
+	}
+	return writeConfig(m.configPath, config)
+}
+
+func writeConfig(path string, config Config) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return toml.NewEncoder(f).Encode(config)
+}
+
+// encSecretPrefix marks a config value as AES-256-GCM ciphertext produced
+// by encryptSecret, so decryptSecret can tell it apart from a secret the
+// user pasted into the config file in plaintext (e.g. client_secret on
+// first bootstrap, before anything has been persisted back).
+const encSecretPrefix = "enc:"
+
+// secretKeySuffix names the file, next to the config file, that holds the
+// random AES key used to encrypt secrets at rest. It's generated on first
+// use and never written into the TOML config itself.
+const secretKeySuffix = ".key"
+
+// loadOrCreateKey returns the AES-256 key used to encrypt secrets in
+// configPath, generating and persisting one (mode 0600) if none exists yet
+// or if the existing key file is not exactly 32 bytes long.
+func loadOrCreateKey(configPath string) ([]byte, error) {
+	keyPath := configPath + secretKeySuffix
+	key, err := ioutil.ReadFile(keyPath)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encryptSecret seals plaintext with AES-256-GCM under key and returns it
+// as a base64 string tagged with encSecretPrefix. An empty plaintext is
+// left empty, so unused fields like refresh_token don't round-trip as
+// ciphertext of the empty string.
+func encryptSecret(key []byte, plaintext string) string {
+	if plaintext == "" {
+		return ""
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// key is always 32 bytes from loadOrCreateKey, so this can't happen.
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encSecretPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// decryptSecret reverses encryptSecret. Values without encSecretPrefix are
+// returned unchanged, so a secret typed directly into the config file
+// (e.g. client_secret, before the first -auth run) still works.
+func decryptSecret(key []byte, value string) (string, error) {
+	if !strings.HasPrefix(value, encSecretPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func exchangeToken(form url.Values) (*tokenResponse, error) {
+	resp, err := http.PostForm(nestTokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP code %d: %s", resp.StatusCode, body)
+	}
+	var tok tokenResponse
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+// runAuthFlow drives the OAuth2 authorization-code flow: it prints the
+// consent URL, listens on listenAddr for the callback, exchanges the
+// resulting code for a token, and writes it back to configPath.
+func runAuthFlow(configPath string, config Config, listenAddr string) error {
+	key, err := loadOrCreateKey(configPath)
+	if err != nil {
+		return fmt.Errorf("loading token encryption key: %w", err)
+	}
+	clientSecret, err := decryptSecret(key, config.ClientSecret)
+	if err != nil {
+		return fmt.Errorf("decrypting client_secret: %w", err)
+	}
+	if config.ClientID == "" || clientSecret == "" {
+		return fmt.Errorf("client_id and client_secret must be set in %s before running -auth", configPath)
+	}
+
+	state, err := randomState()
+	if err != nil {
+		return err
+	}
+
+	consentURL := fmt.Sprintf("%s?client_id=%s&state=%s", nestAuthURL,
+		url.QueryEscape(config.ClientID), url.QueryEscape(state))
+	fmt.Println("Open this URL in a browser and authorize the app:")
+	fmt.Println(consentURL)
+
+	code, err := waitForCallback(listenAddr, state)
+	if err != nil {
+		return err
+	}
+
+	tok, err := exchangeToken(url.Values{
+		"client_id":     {config.ClientID},
+		"client_secret": {clientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+	})
+	if err != nil {
+		return fmt.Errorf("exchanging authorization code: %w", err)
+	}
+
+	config.Token = encryptSecret(key, tok.AccessToken)
+	config.RefreshToken = encryptSecret(key, tok.RefreshToken)
+	config.ClientSecret = encryptSecret(key, clientSecret)
+	if tok.ExpiresIn > 0 {
+		config.TokenExpiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second).Unix()
+	}
+	if err := writeConfig(configPath, config); err != nil {
+		return err
+	}
+
+	log.Println("Token saved to", configPath)
+	return nil
+}
+
+// waitForCallback listens on listenAddr for the OAuth2 redirect and
+// returns the authorization code it carries, once a request arrives with
+// the expected state.
+func waitForCallback(listenAddr, wantState string) (string, error) {
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != wantState {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			errCh <- fmt.Errorf("unexpected state %q in callback", q.Get("state"))
+			return
+		}
+		code := q.Get("code")
+		if code == "" {
+			http.Error(w, "missing code", http.StatusBadRequest)
+			errCh <- fmt.Errorf("no code in callback: %s", r.URL.RawQuery)
+			return
+		}
+		fmt.Fprintln(w, "Authorization complete, you can close this window.")
+		codeCh <- code
+	})
+
+	srv := &http.Server{Addr: listenAddr, Handler: mux}
+	go srv.ListenAndServe()
+	defer srv.Close()
+
+	select {
+	case code := <-codeCh:
+		return code, nil
+	case err := <-errCh:
+		return "", err
+	}
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
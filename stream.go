@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics for the SSE stream. These are incremented directly as events
+// arrive rather than collected from a cache, the same reasoning as
+// writeAttemptsStat in control.go.
+var (
+	streamEventsStat = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nest_stream_events_total",
+			Help: "Count of events received from the Nest REST Streaming API, by event type",
+		},
+		[]string{"type"},
+	)
+	streamReconnectsStat = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "nest_stream_reconnects_total",
+			Help: "Count of attempts to reconnect to the Nest REST Streaming API after a disconnect or failed connection",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(streamEventsStat)
+	prometheus.MustRegister(streamReconnectsStat)
+}
+
+const (
+	streamMinBackoff = time.Second
+	streamMaxBackoff = time.Minute
+)
+
+// runStream maintains a persistent connection to the Nest REST Streaming
+// API (https://developers.nest.com/documentation/cloud/rest-streaming-guide)
+// and updates the device cache every time a "put" event arrives, instead of
+// polling on a fixed interval. Disconnects are retried with exponential
+// backoff and jitter.
+func (c *nestCollector) runStream() {
+	backoff := streamMinBackoff
+	for {
+		err := c.streamOnce()
+		c.setStreamConnected(false)
+		if err != nil {
+			log.Println("nest stream error:", err)
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Printf("reconnecting to Nest stream in %s", sleep)
+		time.Sleep(sleep)
+
+		streamReconnectsStat.Inc()
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// streamOnce opens a single SSE connection and processes events from it
+// until the connection drops or an unrecoverable error occurs.
+func (c *nestCollector) streamOnce() error {
+	// See https://developers.nest.com/documentation/cloud/how-to-handle-redirects#store_the_redirected_location
+	// for why there is a cached redirect URL; it's shared with the poll
+	// path since both hit the same API root resource.
+	url := CachedRedirectURL
+	if url == "" {
+		url = "https://developer-api.nest.com/?auth=" + c.tm.Token()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if respURL := resp.Request.URL.String(); respURL != url {
+		CachedRedirectURL = respURL
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			if err := c.tm.Refresh(); err != nil {
+				return fmt.Errorf("token expired and refresh failed: %w", err)
+			}
+			// The cached URL carries the old token, so drop it.
+			CachedRedirectURL = ""
+			return fmt.Errorf("token expired, refreshed for the next attempt")
+		}
+		return fmt.Errorf("HTTP code %d: %s", resp.StatusCode, body)
+	}
+
+	c.setStreamConnected(true)
+	log.Println("connected to Nest stream")
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			// Blank line terminates an event.
+			if event != "" {
+				c.handleStreamEvent(event, data)
+			}
+			event, data = "", ""
+		}
+	}
+	return scanner.Err()
+}
+
+// streamPutEvent is the payload shape of a Nest "put" event: a snapshot of
+// the resource at path, which for the root stream is the same shape as
+// the NestData struct returned by a poll.
+type streamPutEvent struct {
+	Data NestData `json:"data"`
+}
+
+func (c *nestCollector) handleStreamEvent(event, data string) {
+	streamEventsStat.WithLabelValues(event).Inc()
+
+	switch event {
+	case "put":
+		var put streamPutEvent
+		if err := json.Unmarshal([]byte(data), &put); err != nil {
+			log.Println("nest stream: bad put payload:", err)
+			return
+		}
+		c.setFromStream(&put.Data)
+	case "keep-alive":
+		// Nothing to do, this just tells us the connection is alive.
+	case "auth_revoked":
+		log.Println("nest stream: auth revoked, refreshing token")
+		if err := c.tm.Refresh(); err != nil {
+			log.Println("nest stream: token refresh failed:", err)
+		}
+	}
+}